@@ -0,0 +1,291 @@
+package zeroconf
+
+// Structured, per-interface socket layer. Rather than one shared
+// multicast socket per IP version, a connection keeps a multicast
+// listener and a unicast sender apart for each of ipv4/ipv6, so
+// outbound queries go out from the ephemeral unicast socket while
+// responses still come in on 5353, and joins a caller-selected set of
+// interfaces individually instead of relying on a nil-interface
+// JoinGroup (unreliable on multi-homed hosts and Android).
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	dns "github.com/miekg/godns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+type connection struct {
+	zone   Zone
+	ifaces []*net.Interface
+
+	v4mcast *ipv4.PacketConn
+	v6mcast *ipv6.PacketConn
+	v4ucast *ipv4.PacketConn
+	v6ucast *ipv6.PacketConn
+}
+
+// newConnection binds the requested sockets and starts a read loop on
+// each. ifaces, when empty, defaults to every interface net.Interfaces
+// reports.
+func newConnection(z Zone, ifaces []*net.Interface, useV4, useV6 bool) (*connection, error) {
+	if len(ifaces) == 0 {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+		ifaces = make([]*net.Interface, len(all))
+		for i := range all {
+			ifaces[i] = &all[i]
+		}
+	}
+	ifaces = usableInterfaces(ifaces)
+	c := &connection{zone: z, ifaces: ifaces}
+
+	if useV4 {
+		if err := c.bindV4(ifaces); err != nil {
+			return nil, err
+		}
+	}
+	if useV6 {
+		if err := c.bindV6(ifaces); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// usableInterfaces filters ifaces down to the ones worth joining a
+// multicast group on: up, and multicast-capable. Loopback and down
+// interfaces exist on virtually every host, and a JoinGroup against
+// one of them used to be the first (and fatal) error newConnection
+// hit.
+func usableInterfaces(ifaces []*net.Interface) []*net.Interface {
+	var usable []*net.Interface
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		usable = append(usable, ifi)
+	}
+	return usable
+}
+
+func (c *connection) bindV4(ifaces []*net.Interface) error {
+	mc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: IPv4MCASTADDR.Port})
+	if err != nil {
+		return err
+	}
+	p := ipv4.NewPacketConn(mc)
+	for _, ifi := range ifaces {
+		if err := p.JoinGroup(ifi, &net.UDPAddr{IP: IPv4MCASTADDR.IP}); err != nil {
+			log.Printf("mdns: skipping interface %s for ipv4 multicast: %v", ifi.Name, err)
+		}
+	}
+	p.SetControlMessage(ipv4.FlagInterface, true)
+	c.v4mcast = p
+
+	uc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return err
+	}
+	c.v4ucast = ipv4.NewPacketConn(uc)
+	c.v4ucast.SetControlMessage(ipv4.FlagInterface, true)
+
+	go c.readLoopV4(c.v4mcast)
+	go c.readLoopV4(c.v4ucast)
+	return nil
+}
+
+func (c *connection) bindV6(ifaces []*net.Interface) error {
+	mc, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified, Port: IPv6MCASTADDR.Port})
+	if err != nil {
+		return err
+	}
+	p := ipv6.NewPacketConn(mc)
+	for _, ifi := range ifaces {
+		if err := p.JoinGroup(ifi, &net.UDPAddr{IP: IPv6MCASTADDR.IP}); err != nil {
+			log.Printf("mdns: skipping interface %s for ipv6 multicast: %v", ifi.Name, err)
+		}
+	}
+	p.SetControlMessage(ipv6.FlagInterface, true)
+	c.v6mcast = p
+
+	uc, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		return err
+	}
+	c.v6ucast = ipv6.NewPacketConn(uc)
+	c.v6ucast.SetControlMessage(ipv6.FlagInterface, true)
+
+	go c.readLoopV6(c.v6mcast)
+	go c.readLoopV6(c.v6ucast)
+	return nil
+}
+
+// sendQuestion writes q, from whichever unicast sockets are bound, to
+// the mDNS multicast groups.
+func (c *connection) sendQuestion(q dns.Question) error {
+	msg := new(dns.Msg)
+	msg.Question = []dns.Question{q}
+	buf, ok := msg.Pack()
+	if !ok {
+		return fmt.Errorf("mdns: failed to pack question")
+	}
+	var firstErr error
+	if c.v4ucast != nil {
+		if _, err := c.v4ucast.WriteTo(buf, nil, IPv4MCASTADDR); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if c.v6ucast != nil {
+		if _, err := c.v6ucast.WriteTo(buf, nil, IPv6MCASTADDR); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (c *connection) readLoopV4(pc *ipv4.PacketConn) {
+	buf := make([]byte, 1500)
+	write := func(b []byte, dst net.Addr) error {
+		_, err := pc.WriteTo(b, nil, dst)
+		return err
+	}
+	for {
+		n, cm, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		ifIndex := 0
+		if cm != nil {
+			ifIndex = cm.IfIndex
+		}
+		c.handle(buf[:n], src, ifIndex, write)
+	}
+}
+
+func (c *connection) readLoopV6(pc *ipv6.PacketConn) {
+	buf := make([]byte, 1500)
+	write := func(b []byte, dst net.Addr) error {
+		_, err := pc.WriteTo(b, nil, dst)
+		return err
+	}
+	for {
+		n, cm, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		ifIndex := 0
+		if cm != nil {
+			ifIndex = cm.IfIndex
+		}
+		c.handle(buf[:n], src, ifIndex, write)
+	}
+}
+
+// handle unpacks an incoming packet, answering it if it's a question
+// and otherwise folding its answers into the zone.
+func (c *connection) handle(buf []byte, src net.Addr, ifIndex int, write func([]byte, net.Addr) error) {
+	msg := new(dns.Msg)
+	if !msg.Unpack(buf) {
+		return
+	}
+	udpSrc, _ := src.(*net.UDPAddr)
+
+	if !msg.IsQuestion() {
+		for _, rr := range msg.Answer {
+			c.zone.Add(&Entry{
+				Expires: time.Now().UnixNano() + int64(rr.Header().Ttl)*seconds,
+				Publish: false,
+				RR:      rr,
+				Source:  udpSrc,
+				IfIndex: ifIndex,
+			})
+		}
+		return
+	}
+
+	r := new(dns.Msg)
+	r.MsgHdr.Response = true
+	for _, q := range msg.Question {
+		results, additionals := c.zone.QueryAdditional(q)
+		for _, result := range results {
+			if result.Publish {
+				r.Answer = append(r.Answer, result.RR)
+			}
+		}
+		for _, additional := range additionals {
+			if additional.Publish {
+				r.Extra = append(r.Extra, additional.RR)
+			}
+		}
+	}
+	if len(r.Answer) == 0 {
+		return
+	}
+	r.Extra = append(r.Extra, findAdditional(c.zone, r.Answer, msg.Answer)...)
+	if out, ok := r.Pack(); ok {
+		write(out, src)
+	}
+}
+
+// findAdditional composes the additional (Extra) section for a set of
+// answers, pulling in the SRV/TXT/A/AAAA records a well-behaved
+// responder bundles alongside a PTR/SRV/A/AAAA answer so clients don't
+// need a second round-trip. known is the querying message's own
+// Answer section (RFC 6762 known-answer suppression); an RR is left
+// out when one with the same name and type (see containsRR) is already
+// there, already in answers, or already added.
+func findAdditional(z Zone, answers []dns.RR, known []dns.RR) []dns.RR {
+	var extra []dns.RR
+	add := func(candidates []*Entry) {
+		for _, e := range candidates {
+			if !e.Publish {
+				continue
+			}
+			if containsRR(answers, e.RR) || containsRR(extra, e.RR) || containsRR(known, e.RR) {
+				continue
+			}
+			extra = append(extra, e.RR)
+		}
+	}
+
+	for _, rr := range answers {
+		switch v := rr.(type) {
+		case *dns.RR_PTR:
+			srvs := z.Query(dns.Question{v.Ptr, dns.TypeSRV, dns.ClassINET})
+			add(srvs)
+			add(z.Query(dns.Question{v.Ptr, dns.TypeTXT, dns.ClassINET}))
+			for _, srv := range srvs {
+				if s, ok := srv.RR.(*dns.RR_SRV); ok {
+					add(z.Query(dns.Question{s.Target, dns.TypeA, dns.ClassINET}))
+					add(z.Query(dns.Question{s.Target, dns.TypeAAAA, dns.ClassINET}))
+				}
+			}
+		case *dns.RR_SRV:
+			add(z.Query(dns.Question{v.Target, dns.TypeA, dns.ClassINET}))
+			add(z.Query(dns.Question{v.Target, dns.TypeAAAA, dns.ClassINET}))
+		case *dns.RR_A:
+			add(z.Query(dns.Question{v.Hdr.Name, dns.TypeAAAA, dns.ClassINET}))
+		case *dns.RR_AAAA:
+			add(z.Query(dns.Question{v.Hdr.Name, dns.TypeA, dns.ClassINET}))
+		}
+	}
+	return extra
+}
+
+// containsRR reports whether rrs already holds a record for the same
+// name and type as rr.
+func containsRR(rrs []dns.RR, rr dns.RR) bool {
+	for _, r := range rrs {
+		if r.Header().Name == rr.Header().Name && r.Header().Rrtype == rr.Header().Rrtype {
+			return true
+		}
+	}
+	return false
+}
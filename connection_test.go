@@ -0,0 +1,103 @@
+package zeroconf
+
+import (
+	"net"
+	"testing"
+
+	dns "github.com/miekg/godns"
+)
+
+func TestUsableInterfacesFiltersDownAndNonMulticast(t *testing.T) {
+	up := &net.Interface{Name: "eth0", Flags: net.FlagUp | net.FlagMulticast}
+	down := &net.Interface{Name: "eth1", Flags: net.FlagMulticast}
+	noMulticast := &net.Interface{Name: "lo", Flags: net.FlagUp}
+
+	got := usableInterfaces([]*net.Interface{up, down, noMulticast})
+
+	if len(got) != 1 || got[0] != up {
+		t.Fatalf("usableInterfaces = %v, want only %v", got, up)
+	}
+}
+
+func TestNewConnectionBindsIPv4Sockets(t *testing.T) {
+	z := newTestZone(nil)
+	c, err := newConnection(z, nil, true, false)
+	if err != nil {
+		t.Fatalf("newConnection: %v", err)
+	}
+	if c.v4mcast == nil || c.v4ucast == nil {
+		t.Fatal("newConnection did not bind the expected ipv4 multicast/unicast sockets")
+	}
+	if err := c.sendQuestion(dns.Question{"_test._tcp.local.", dns.TypePTR, dns.ClassINET}); err != nil {
+		t.Fatalf("sendQuestion: %v", err)
+	}
+}
+
+func TestContainsRRMatchesByNameAndType(t *testing.T) {
+	a := newPTR("svc.local.", "inst.svc.local.")
+	sameNameType := newPTR("svc.local.", "other.svc.local.")
+	differentName := newPTR("other.local.", "inst.svc.local.")
+
+	if !containsRR([]dns.RR{a}, sameNameType) {
+		t.Fatal("containsRR missed a record sharing name and type, even with different rdata")
+	}
+	if containsRR([]dns.RR{a}, differentName) {
+		t.Fatal("containsRR matched records with different owner names")
+	}
+}
+
+func TestFindAdditionalBundlesSRVTXTAndAddress(t *testing.T) {
+	ptr := newPTR("_svc._tcp.local.", "inst._svc._tcp.local.")
+
+	srv := dns.NewRR(dns.TypeSRV).(*dns.RR_SRV)
+	srv.Hdr.Name = "inst._svc._tcp.local."
+	srv.Hdr.Class = dns.ClassINET
+	srv.Target = "host.local."
+	srv.Port = 1234
+
+	txt := dns.NewRR(dns.TypeTXT).(*dns.RR_TXT)
+	txt.Hdr.Name = "inst._svc._tcp.local."
+	txt.Hdr.Class = dns.ClassINET
+	txt.Txt = []string{"a=1"}
+
+	a := dns.NewRR(dns.TypeA).(*dns.RR_A)
+	a.Hdr.Name = "host.local."
+	a.Hdr.Class = dns.ClassINET
+	a.A = net.ParseIP("192.0.2.1")
+
+	z := newTestZone(map[string]entries{
+		"inst._svc._tcp.local.": {
+			{Publish: true, RR: srv},
+			{Publish: true, RR: txt},
+		},
+		"host.local.": {
+			{Publish: true, RR: a},
+		},
+	})
+
+	extra := findAdditional(z, []dns.RR{ptr}, nil)
+
+	var haveSRV, haveTXT, haveA bool
+	for _, rr := range extra {
+		switch rr.(type) {
+		case *dns.RR_SRV:
+			haveSRV = true
+		case *dns.RR_TXT:
+			haveTXT = true
+		case *dns.RR_A:
+			haveA = true
+		}
+	}
+	if !haveSRV || !haveTXT || !haveA {
+		t.Fatalf("findAdditional = %v, want SRV+TXT+A bundled in for the PTR answer", extra)
+	}
+
+	// known-answer suppression: an SRV the querier already has must not
+	// be duplicated into Extra.
+	extra = findAdditional(z, []dns.RR{ptr}, []dns.RR{srv})
+	for _, rr := range extra {
+		if _, ok := rr.(*dns.RR_SRV); ok {
+			t.Fatal("findAdditional re-added an SRV already present in the known-answer section")
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"os"
 	"strings"
 	"time"
 
@@ -23,6 +22,7 @@ type Service struct {
 	*Host
 	*Type
 	Port uint16
+	TXT  []string // key=value entries encoded into the TXT RDATA, RFC 6763 §6
 }
 
 type proto int
@@ -39,25 +39,54 @@ const (
 	udp
 )
 
+// ServiceTypeEnumerationDomain is the well-known meta-query name a
+// DNS-SD client uses to discover which service types are present in a
+// domain, RFC 6763 §9.
+const ServiceTypeEnumerationDomain = "_services._dns-sd._udp.local."
+
+// Type is a DNS-SD service type: the `_service._proto` pair a service
+// is browsed under, plus any subtypes it additionally advertises and
+// the domain it's scoped to.
 type Type struct {
-	name string
-	proto
+	Name     string
+	Protocol proto
+	Subtypes []string
+	Domain   string // defaults to "local." when empty
 }
 
 var (
-	Ssh = &Type{"_ssh", tcp}
+	Ssh = &Type{Name: "_ssh", Protocol: tcp}
 )
 
+func (t *Type) domain() string {
+	if t.Domain != "" {
+		return t.Domain
+	}
+	return "local."
+}
+
+// service renders "_service._proto.domain.".
+func (t *Type) service() string {
+	return fmt.Sprintf("%s.%s.%s", t.Name, t.Protocol.String(), t.domain())
+}
+
+// subtypeService renders "<subtype>._sub._service._proto.domain." for
+// the given subtype, the name subtype browsing PTR queries are answered
+// under.
+func (t *Type) subtypeService(subtype string) string {
+	return fmt.Sprintf("%s._sub.%s", subtype, t.service())
+}
+
 func (s *Service) fqdn() string {
-	return fmt.Sprintf("%s.%s", s.Name, s.Domain)
+	return fmt.Sprintf("%s.%s", s.Host.Name, s.Host.Domain)
 }
 
 func (s *Service) service() string {
-	return fmt.Sprintf("%s.%s.%s", s.Type.name, s.Type.proto.String(), s.Domain)
+	return s.Type.service()
 }
 
 func (s *Service) serviceFqdn() string {
-	return s.Name + "." + s.service()
+	return s.Host.Name + "." + s.service()
 }
 
 func Publish(z Zone, s *Service) {
@@ -77,6 +106,15 @@ func Publish(z Zone, s *Service) {
 	ptr.Ptr = s.serviceFqdn()
 	PublishRR(z, ptr)
 
+	for _, subtype := range s.Type.Subtypes {
+		sub := dns.NewRR(dns.TypePTR).(*dns.RR_PTR)
+		sub.Hdr.Name = s.Type.subtypeService(subtype)
+		sub.Hdr.Class = dns.ClassINET
+		sub.Hdr.Ttl = 3600
+		sub.Ptr = s.serviceFqdn()
+		PublishRR(z, sub)
+	}
+
 	srv := dns.NewRR(dns.TypeSRV).(*dns.RR_SRV)
 	srv.Hdr.Name = s.serviceFqdn()
 	srv.Hdr.Class = dns.ClassINET
@@ -89,6 +127,7 @@ func Publish(z Zone, s *Service) {
 	txt.Hdr.Name = s.serviceFqdn()
 	txt.Hdr.Class = dns.ClassINET
 	txt.Hdr.Ttl = 3600
+	txt.Txt = s.TXT
 	PublishRR(z, txt)
 }
 
@@ -104,6 +143,9 @@ type Entry struct {
 	Publish bool  // whether this entry should be broadcast in response to an mDNS question
 	RR      dns.RR
 	Source  *net.UDPAddr
+	IfIndex int // index of the interface the packet carrying RR arrived on
+
+	refreshed int // number of RFC 6762 §10.1 refresh thresholds (80/85/90/95%) already requested
 }
 
 func (e *Entry) fqdn() string {
@@ -129,50 +171,127 @@ type Query struct {
 
 type entries []*Entry
 
-func (e entries) contains(entry *Entry) bool {
+func (e entries) find(entry *Entry) *Entry {
 	for _, ee := range e {
 		if equals(ee.RR, entry.RR) {
-			return true
+			return ee
 		}
 	}
-	return false
+	return nil
 }
 
 type zone struct {
-	Domain        string
-	entries       map[string]entries
-	add           chan *Entry // add entries to zone
-	query         chan *Query // query exsting entries in zone
-	subscribe     chan *Query // subscribe to new entries added to zone
-	subscriptions []*Query
+	Domain          string
+	entries         map[string]entries
+	add             chan *Entry // add entries to zone
+	query           chan *Query // query exsting entries in zone
+	subscribe       chan *Query // subscribe to new entries added to zone
+	remove          chan *Entry      // remove entries from zone
+	unsubscribe     chan chan *Entry // cancel a prior Subscribe
+	subscriptions   []*Query
+	cleanupInterval time.Duration
+
+	ifaces   []*net.Interface
+	ipv4Only bool
+	ipv6Only bool
+	conn     *connection
 }
 
 type Zone interface {
 	Query(dns.Question) []*Entry
 	QueryAdditional(dns.Question) ([]*Entry, []*Entry)
 	Subscribe(uint16) chan *Entry
+	// Unsubscribe cancels a channel previously returned by Subscribe.
+	// Callers must call it once they stop reading from the channel, or
+	// publish will eventually block forever delivering to it and
+	// freeze the zone for every other caller.
+	Unsubscribe(chan *Entry)
 	Add(*Entry)
+	Remove(*Entry)
+	// SendQuestion broadcasts q from the zone's unicast socket, so that
+	// answers trickle back in through Add and become visible to
+	// Subscribe/Query callers.
+	SendQuestion(q dns.Question) error
+}
+
+// Option configures a zone constructed by NewZone.
+type Option func(*zone)
+
+// defaultCleanupInterval is how often the zone sweeps z.entries for
+// expired records when no WithCleanupInterval option is given.
+const defaultCleanupInterval = 10 * time.Second
+
+// WithCleanupInterval overrides how often the zone checks z.entries
+// for expired or refreshable records.
+func WithCleanupInterval(d time.Duration) Option {
+	return func(z *zone) {
+		z.cleanupInterval = d
+	}
 }
 
-func NewLocalZone() Zone {
+// WithInterfaces restricts the zone to the given interfaces instead of
+// binding on every interface reported by net.Interfaces.
+func WithInterfaces(ifaces ...*net.Interface) Option {
+	return func(z *zone) {
+		z.ifaces = ifaces
+	}
+}
+
+// WithIPv4Only disables the zone's IPv6 multicast and unicast sockets.
+func WithIPv4Only() Option {
+	return func(z *zone) {
+		z.ipv4Only = true
+	}
+}
+
+// WithIPv6Only disables the zone's IPv4 multicast and unicast sockets.
+func WithIPv6Only() Option {
+	return func(z *zone) {
+		z.ipv6Only = true
+	}
+}
+
+// NewZone constructs a Zone and binds its multicast sockets, returning
+// an error rather than killing the process if a bind fails on one
+// stack.
+func NewZone(opts ...Option) (Zone, error) {
 	z := &zone{
-		Domain:    "local.",
-		entries:   make(map[string]entries),
-		add:       make(chan *Entry, 16),
-		query:     make(chan *Query, 16),
-		subscribe: make(chan *Query, 16),
+		Domain:          "local.",
+		entries:         make(map[string]entries),
+		add:             make(chan *Entry, 16),
+		query:           make(chan *Query, 16),
+		subscribe:       make(chan *Query, 16),
+		remove:          make(chan *Entry, 16),
+		unsubscribe:     make(chan chan *Entry, 16),
+		cleanupInterval: defaultCleanupInterval,
+	}
+	for _, opt := range opts {
+		opt(z)
 	}
 	go z.mainloop()
-	if err := z.listen(IPv4MCASTADDR); err != nil {
-		log.Fatal("Failed to listen: ", err)
+
+	conn, err := newConnection(z, z.ifaces, !z.ipv6Only, !z.ipv4Only)
+	if err != nil {
+		return nil, err
 	}
-	if err := z.listen(IPv6MCASTADDR); err != nil {
+	z.conn = conn
+	return z, nil
+}
+
+// NewLocalZone is NewZone for callers who would rather have a bind
+// failure kill the process than thread an error through their own
+// constructor.
+func NewLocalZone(opts ...Option) Zone {
+	z, err := NewZone(opts...)
+	if err != nil {
 		log.Fatal("Failed to listen: ", err)
 	}
 	return z
 }
 
 func (z *zone) mainloop() {
+	ticker := time.NewTicker(z.cleanupInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case entry := <-z.add:
@@ -181,6 +300,12 @@ func (z *zone) mainloop() {
 			z.query0(q)
 		case q := <-z.subscribe:
 			z.subscriptions = append(z.subscriptions, q)
+		case e := <-z.remove:
+			z.remove0(e)
+		case ch := <-z.unsubscribe:
+			z.unsubscribe0(ch)
+		case <-ticker.C:
+			z.cleanup()
 		}
 	}
 }
@@ -189,6 +314,10 @@ func (z *zone) Add(e *Entry) {
 	z.add <- e
 }
 
+func (z *zone) Remove(e *Entry) {
+	z.remove <- e
+}
+
 func (z *zone) Subscribe(t uint16) chan *Entry {
 	res := make(chan *Entry, 16)
 	z.subscribe <- &Query{
@@ -202,6 +331,19 @@ func (z *zone) Subscribe(t uint16) chan *Entry {
 	return res
 }
 
+func (z *zone) Unsubscribe(ch chan *Entry) {
+	z.unsubscribe <- ch
+}
+
+func (z *zone) unsubscribe0(ch chan *Entry) {
+	for i, q := range z.subscriptions {
+		if q.Result == ch {
+			z.subscriptions = append(z.subscriptions[:i], z.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
 func (z *zone) Query(q dns.Question) (entries []*Entry) {
 	res := make(chan *Entry, 16)
 	z.query <- &Query{q, res}
@@ -216,10 +358,20 @@ func (z *zone) QueryAdditional(q dns.Question) ([]*Entry, []*Entry) {
 }
 
 func (z *zone) add0(entry *Entry) {
-	if !z.entries[entry.fqdn()].contains(entry) {
-		z.entries[entry.fqdn()] = append(z.entries[entry.fqdn()], entry)
-		z.publish(entry)
+	fqdn := entry.fqdn()
+	if existing := z.entries[fqdn].find(entry); existing != nil {
+		// Same rdata re-announced - most often the answer to the
+		// refresh maybeRefresh itself requested. Refresh its lifetime
+		// in place rather than dropping the answer, or the entry would
+		// still expire on its original schedule and cleanup would send
+		// a false goodbye for a service that's actively being renewed.
+		existing.Expires = entry.Expires
+		existing.refreshed = 0
+		z.publish(existing)
+		return
 	}
+	z.entries[fqdn] = append(z.entries[fqdn], entry)
+	z.publish(entry)
 }
 
 func (z *zone) publish(entry *Entry) {
@@ -230,7 +382,94 @@ func (z *zone) publish(entry *Entry) {
 	}
 }
 
+func (z *zone) remove0(entry *Entry) {
+	es := z.entries[entry.fqdn()]
+	for i, e := range es {
+		if e == entry || equals(e.RR, entry.RR) {
+			z.entries[entry.fqdn()] = append(es[:i], es[i+1:]...)
+			if !e.Publish {
+				z.goodbye(e)
+			}
+			return
+		}
+	}
+}
+
+// cleanup walks z.entries, evicting records whose Expires has passed
+// and re-questioning records that are due for an RFC 6762 §10.1
+// refresh and still have an interested subscriber.
+func (z *zone) cleanup() {
+	now := time.Now().UnixNano()
+	for key, es := range z.entries {
+		var live entries
+		for _, e := range es {
+			if e.Expires == 0 {
+				live = append(live, e)
+				continue
+			}
+			if now >= e.Expires {
+				if !e.Publish {
+					z.goodbye(e)
+				}
+				continue
+			}
+			z.maybeRefresh(e, now)
+			live = append(live, e)
+		}
+		if len(live) == 0 {
+			delete(z.entries, key)
+		} else {
+			z.entries[key] = live
+		}
+	}
+}
+
+// goodbye emits a synthetic Entry with a zeroed TTL so subscribers can
+// react to the record's disappearance, mirroring a real goodbye packet.
+func (z *zone) goodbye(e *Entry) {
+	e.RR.Header().Ttl = 0
+	z.publish(e)
+}
+
+var refreshThresholds = []float64{0.80, 0.85, 0.90, 0.95}
+
+func (z *zone) maybeRefresh(e *Entry, now int64) {
+	if e.Publish || e.refreshed >= len(refreshThresholds) {
+		return
+	}
+	total := int64(e.RR.Header().Ttl) * seconds
+	if total == 0 {
+		return
+	}
+	elapsed := total - (e.Expires - now)
+	if float64(elapsed)/float64(total) < refreshThresholds[e.refreshed] {
+		return
+	}
+	e.refreshed++
+	if z.hasSubscriber(e.RR.Header().Rrtype) {
+		z.SendQuestion(dns.Question{e.fqdn(), e.RR.Header().Rrtype, dns.ClassINET})
+	}
+}
+
+func (z *zone) hasSubscriber(t uint16) bool {
+	for _, s := range z.subscriptions {
+		if s.Question.Qtype == dns.TypeANY || s.Question.Qtype == t {
+			return true
+		}
+	}
+	return false
+}
+
 func (z *zone) query0(query *Query) {
+	if query.Question.Name == ServiceTypeEnumerationDomain {
+		for _, entry := range z.serviceTypeEnumeration() {
+			if query.matches(entry) {
+				query.Result <- entry
+			}
+		}
+		close(query.Result)
+		return
+	}
 	for _, entry := range z.entries[query.Question.Name] {
 		if query.matches(entry) {
 			query.Result <- entry
@@ -239,10 +478,44 @@ func (z *zone) query0(query *Query) {
 	close(query.Result)
 }
 
+// serviceTypeEnumeration answers the RFC 6763 §9 meta-query by
+// synthesizing a PTR for every distinct "_service._proto.domain" owner
+// name published in the zone. Subtype PTRs aren't service types in
+// their own right, so they're excluded.
+func (z *zone) serviceTypeEnumeration() []*Entry {
+	var result []*Entry
+	for name, es := range z.entries {
+		if strings.Contains(name, "._sub.") || name == ServiceTypeEnumerationDomain {
+			continue
+		}
+		for _, e := range es {
+			if _, ok := e.RR.(*dns.RR_PTR); !ok || !e.Publish {
+				continue
+			}
+			ptr := dns.NewRR(dns.TypePTR).(*dns.RR_PTR)
+			ptr.Hdr.Name = ServiceTypeEnumerationDomain
+			ptr.Hdr.Class = dns.ClassINET
+			ptr.Hdr.Ttl = 4500
+			ptr.Ptr = name
+			result = append(result, &Entry{Publish: true, RR: ptr})
+			break
+		}
+	}
+	return result
+}
+
 func (q *Query) matches(entry *Entry) bool {
 	return q.Question.Qtype == dns.TypeANY || q.Question.Qtype == entry.RR.Header().Rrtype
 }
 
+// equals reports whether this and that are the same record: either
+// one is the *RR_ANY wildcard, or they share a name, type and rdata.
+// Rdata is compared for A, AAAA, PTR, SRV (target and port only) and
+// TXT; any other type is equal only to the identical RR value.
+// Two distinct *Entry pointers built from equivalent RRs (as a caller
+// reconstructing an Entry to pass to Zone.Remove would) must compare
+// equal here, or remove0's lookup only ever matches the exact
+// original RR value.
 func equals(this, that dns.RR) bool {
 	if _, ok := this.(*dns.RR_ANY); ok {
 		return true // *RR_ANY matches anything
@@ -250,7 +523,35 @@ func equals(this, that dns.RR) bool {
 	if _, ok := that.(*dns.RR_ANY); ok {
 		return true // *RR_ANY matches all
 	}
-	return false
+	if this.Header().Name != that.Header().Name || this.Header().Rrtype != that.Header().Rrtype {
+		return false
+	}
+	switch a := this.(type) {
+	case *dns.RR_A:
+		b, ok := that.(*dns.RR_A)
+		return ok && a.A.Equal(b.A)
+	case *dns.RR_AAAA:
+		b, ok := that.(*dns.RR_AAAA)
+		return ok && a.AAAA.Equal(b.AAAA)
+	case *dns.RR_PTR:
+		b, ok := that.(*dns.RR_PTR)
+		return ok && a.Ptr == b.Ptr
+	case *dns.RR_SRV:
+		b, ok := that.(*dns.RR_SRV)
+		return ok && a.Target == b.Target && a.Port == b.Port
+	case *dns.RR_TXT:
+		b, ok := that.(*dns.RR_TXT)
+		if !ok || len(a.Txt) != len(b.Txt) {
+			return false
+		}
+		for i := range a.Txt {
+			if a.Txt[i] != b.Txt[i] {
+				return false
+			}
+		}
+		return true
+	}
+	return this == that
 }
 
 const (
@@ -269,128 +570,12 @@ var (
 	}
 )
 
-type connector struct {
-	*net.UDPAddr
-	*net.UDPConn
-	Zone
-}
-
-func (z *zone) listen(addr *net.UDPAddr) os.Error {
-	conn, err := openSocket(addr)
-	if err != nil {
-		return err
-	}
-	if err := conn.JoinGroup(nil, addr.IP); err != nil {
-		return err
-	}
-	c := &connector{
-		UDPAddr: addr,
-		UDPConn: conn,
-		Zone:    z,
-	}
-	go c.mainloop()
-	return nil
-}
-
-func openSocket(addr *net.UDPAddr) (*net.UDPConn, os.Error) {
-	switch addr.IP.To4() {
-	case nil:
-		return net.ListenUDP("udp6", &net.UDPAddr{
-			IP:   net.IPv6zero,
-			Port: addr.Port,
-		})
-	default:
-		return net.ListenUDP("udp4", &net.UDPAddr{
-			IP:   net.IPv4zero,
-			Port: addr.Port,
-		})
-	}
-	panic("unreachable")
-}
-
-func (c *connector) mainloop() {
-	type incoming struct {
-		*dns.Msg
-		*net.UDPAddr
-	}
-	in := make(chan incoming, 32)
-	go func() {
-		for {
-			msg, addr, err := c.readMessage()
-			if err != nil {
-				log.Fatalf("Cound not read from %s: %s", c.UDPConn, err)
-			}
-			in <- incoming{msg, addr}
-		}
-	}()
-
-	for {
-		select {
-		case msg := <-in:
-			if msg.IsQuestion() {
-				r := new(dns.Msg)
-				r.MsgHdr.Response = true
-				results, additionals := c.query(msg.Question)
-				for _, result := range results {
-					if result.Publish {
-						r.Answer = append(r.Answer, result.RR)
-					}
-				}
-				for _, additional := range additionals {
-					if additional.Publish {
-						r.Extra = append(r.Extra, additional.RR)
-					}
-				}
-				if len(r.Answer) > 0 {
-					r.Extra = c.findAdditional(r.Answer)
-					fmt.Println(r)
-					if err := c.writeMessage(r); err != nil {
-						log.Fatalf("Cannot send: %s", err)
-					}
-
-				}
-			} else {
-				for _, rr := range msg.Answer {
-					c.Add(&Entry{
-						Expires: time.Nanoseconds() + int64(rr.Header().Ttl*seconds),
-						Publish: false,
-						RR:      rr,
-						Source:  msg.UDPAddr,
-					})
-				}
-			}
-		}
-	}
-}
-
-func (c *connector) findAdditional(rr []dns.RR) []dns.RR {
-	return []dns.RR{}
-}
-
-func (c *connector) query(qs []dns.Question) (results []*Entry, additionals []*Entry) {
-	for _, q := range qs {
-		result, additional := c.QueryAdditional(q)
-		results = append(results, result...)
-		additionals = append(additionals, additional...)
-	}
-	return
-}
-
-func (c *connector) writeMessage(msg *dns.Msg) (err os.Error) {
-	if buf, ok := msg.Pack(); ok {
-		_, err = c.WriteToUDP(buf, c.UDPAddr)
-	}
-	return
-}
-
-func (c *connector) readMessage() (*dns.Msg, *net.UDPAddr, os.Error) {
-	buf := make([]byte, 1500)
-	read, addr, err := c.ReadFromUDP(buf)
-	if err != nil {
-		return nil, nil, err
-	}
-	if msg := new(dns.Msg); msg.Unpack(buf[:read]) {
-		return msg, addr, nil
+// SendQuestion asks the zone's connection to broadcast q from its
+// unicast socket. Answers arrive asynchronously and are folded into
+// the zone through the normal Add path.
+func (z *zone) SendQuestion(q dns.Question) error {
+	if z.conn == nil {
+		return nil
 	}
-	return nil, addr, os.NewError("Unable to unpack buffer")
+	return z.conn.sendQuestion(q)
 }
\ No newline at end of file
@@ -0,0 +1,226 @@
+package zeroconf
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	dns "github.com/miekg/godns"
+)
+
+// newTestZone returns a zone whose mainloop is running against a
+// pre-seeded entries map, for tests that need to drive Query/Add/etc.
+// through the real actor loop without a live network connection.
+func newTestZone(seed map[string]entries) *zone {
+	if seed == nil {
+		seed = make(map[string]entries)
+	}
+	z := &zone{
+		entries:         seed,
+		add:             make(chan *Entry, 16),
+		query:           make(chan *Query, 16),
+		subscribe:       make(chan *Query, 16),
+		remove:          make(chan *Entry, 16),
+		unsubscribe:     make(chan chan *Entry, 16),
+		cleanupInterval: time.Hour,
+	}
+	go z.mainloop()
+	return z
+}
+
+// waitAdds blocks until z's mainloop has taken every pending Add off
+// the add channel. Add is asynchronous and mainloop picks among ready
+// channels at random, so a Query sent while Adds are still buffered
+// could be answered before those entries land.
+func waitAdds(z *zone) {
+	for len(z.add) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newPTR(name, ptr string) *dns.RR_PTR {
+	rr := dns.NewRR(dns.TypePTR).(*dns.RR_PTR)
+	rr.Hdr.Name = name
+	rr.Hdr.Class = dns.ClassINET
+	rr.Hdr.Ttl = 3600
+	rr.Ptr = ptr
+	return rr
+}
+
+func TestUnsubscribeRemovesSubscription(t *testing.T) {
+	z := &zone{}
+	ch1 := make(chan *Entry, 16)
+	ch2 := make(chan *Entry, 16)
+	z.subscriptions = []*Query{
+		{dns.Question{"", dns.TypeANY, dns.ClassINET}, ch1},
+		{dns.Question{"", dns.TypeANY, dns.ClassINET}, ch2},
+	}
+
+	z.unsubscribe0(ch1)
+	if len(z.subscriptions) != 1 || z.subscriptions[0].Result != ch2 {
+		t.Fatalf("unsubscribe0 did not remove the targeted subscription: %+v", z.subscriptions)
+	}
+
+	// Unsubscribing a channel that's already gone must be a no-op, not
+	// a panic or an accidental removal of the remaining subscription.
+	z.unsubscribe0(ch1)
+	if len(z.subscriptions) != 1 || z.subscriptions[0].Result != ch2 {
+		t.Fatalf("unsubscribe0 of an unknown channel mutated subscriptions: %+v", z.subscriptions)
+	}
+}
+
+func TestPublishDoesNotBlockAfterUnsubscribe(t *testing.T) {
+	z := &zone{}
+	stale := make(chan *Entry, 1)
+	stale <- &Entry{} // fill the buffer so a further send would block forever
+	z.subscriptions = []*Query{
+		{dns.Question{"", dns.TypeANY, dns.ClassINET}, stale},
+	}
+
+	z.unsubscribe0(stale)
+
+	done := make(chan struct{})
+	go func() {
+		z.publish(&Entry{RR: newPTR("probe.local.", "a.local.")})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked delivering to an unsubscribed channel")
+	}
+}
+
+func TestCleanupEvictsExpiredEntries(t *testing.T) {
+	z := &zone{entries: make(map[string]entries)}
+	expired := &Entry{
+		Publish: true,
+		RR:      newPTR("svc.local.", "old.svc.local."),
+		Expires: time.Now().UnixNano() - int64(time.Second),
+	}
+	z.entries[expired.fqdn()] = entries{expired}
+
+	z.cleanup()
+
+	if _, ok := z.entries[expired.fqdn()]; ok {
+		t.Fatalf("cleanup did not evict an expired entry: %+v", z.entries)
+	}
+}
+
+func TestRemoveByEquivalentEntry(t *testing.T) {
+	z := &zone{entries: make(map[string]entries)}
+	original := &Entry{Publish: true, RR: newPTR("svc.local.", "inst.svc.local.")}
+	z.entries[original.fqdn()] = entries{original}
+
+	// A caller reconstructing the Entry it wants removed, rather than
+	// holding onto the exact original pointer, must still work.
+	equivalent := &Entry{Publish: true, RR: newPTR("svc.local.", "inst.svc.local.")}
+	z.remove0(equivalent)
+
+	if len(z.entries[original.fqdn()]) != 0 {
+		t.Fatalf("remove0 did not remove an entry equal to, but not the same pointer as, the original: %+v", z.entries)
+	}
+}
+
+func TestEqualsComparesRdata(t *testing.T) {
+	a := newPTR("svc.local.", "inst.svc.local.")
+	b := newPTR("svc.local.", "inst.svc.local.")
+	if !equals(a, b) {
+		t.Fatal("equals() returned false for two distinct but structurally-equal PTR records")
+	}
+
+	b.Ptr = "other.svc.local."
+	if equals(a, b) {
+		t.Fatal("equals() returned true for two PTR records with different rdata")
+	}
+
+	any := dns.NewRR(dns.TypeANY).(*dns.RR_ANY)
+	if !equals(a, any) || !equals(any, a) {
+		t.Fatal("equals() must still treat *RR_ANY as a wildcard")
+	}
+}
+
+func TestTypeServiceAndSubtypeService(t *testing.T) {
+	ty := &Type{Name: "_http", Protocol: tcp, Subtypes: []string{"_printer"}}
+	if got, want := ty.service(), "_http._tcp.local."; got != want {
+		t.Fatalf("service() = %q, want %q", got, want)
+	}
+	if got, want := ty.subtypeService("_printer"), "_printer._sub._http._tcp.local."; got != want {
+		t.Fatalf("subtypeService() = %q, want %q", got, want)
+	}
+
+	ty.Domain = "example.com."
+	if got, want := ty.service(), "_http._tcp.example.com."; got != want {
+		t.Fatalf("service() with an explicit domain = %q, want %q", got, want)
+	}
+}
+
+func TestPublishAddsSubtypePTRAndTXT(t *testing.T) {
+	z := newTestZone(nil)
+	s := &Service{
+		Host: &Host{Name: "inst", Domain: "local.", Addrs: []net.IP{net.ParseIP("192.0.2.1")}},
+		Type: &Type{Name: "_http", Protocol: tcp, Subtypes: []string{"_printer"}},
+		Port: 80,
+		TXT:  []string{"path=/"},
+	}
+	Publish(z, s)
+	waitAdds(z)
+
+	subResults := z.Query(dns.Question{"_printer._sub._http._tcp.local.", dns.TypePTR, dns.ClassINET})
+	if len(subResults) != 1 {
+		t.Fatalf("Publish did not register a subtype PTR: %+v", subResults)
+	}
+	if ptr := subResults[0].RR.(*dns.RR_PTR); ptr.Ptr != s.serviceFqdn() {
+		t.Fatalf("subtype PTR.Ptr = %q, want %q", ptr.Ptr, s.serviceFqdn())
+	}
+
+	txtResults := z.Query(dns.Question{s.serviceFqdn(), dns.TypeTXT, dns.ClassINET})
+	if len(txtResults) != 1 {
+		t.Fatalf("Publish did not register a TXT record: %+v", txtResults)
+	}
+	if txt := txtResults[0].RR.(*dns.RR_TXT); len(txt.Txt) != 1 || txt.Txt[0] != "path=/" {
+		t.Fatalf("TXT.Txt = %v, want [path=/]", txt.Txt)
+	}
+}
+
+func TestServiceTypeEnumerationListsServicesNotSubtypes(t *testing.T) {
+	z := newTestZone(nil)
+	Publish(z, &Service{
+		Host: &Host{Name: "inst", Domain: "local."},
+		Type: &Type{Name: "_http", Protocol: tcp, Subtypes: []string{"_printer"}},
+		Port: 80,
+	})
+	waitAdds(z)
+
+	results := z.Query(dns.Question{ServiceTypeEnumerationDomain, dns.TypePTR, dns.ClassINET})
+	if len(results) != 1 {
+		t.Fatalf("serviceTypeEnumeration = %+v, want exactly one service type", results)
+	}
+	if ptr := results[0].RR.(*dns.RR_PTR); ptr.Ptr != "_http._tcp.local." {
+		t.Fatalf("enumeration PTR.Ptr = %q, want %q - subtype PTRs must be excluded", ptr.Ptr, "_http._tcp.local.")
+	}
+}
+
+func TestAddRefreshesExistingEntryOnDuplicateRdata(t *testing.T) {
+	z := &zone{entries: make(map[string]entries)}
+	first := &Entry{RR: newPTR("svc.local.", "inst.svc.local."), Expires: 1000}
+	first.refreshed = 3
+	z.add0(first)
+
+	// A re-announcement of the same rdata - e.g. the answer to a
+	// maybeRefresh question - must renew the existing entry in place,
+	// not get dropped as a dup and leave it to expire on schedule.
+	second := &Entry{RR: newPTR("svc.local.", "inst.svc.local."), Expires: 2000}
+	z.add0(second)
+
+	es := z.entries[first.fqdn()]
+	if len(es) != 1 {
+		t.Fatalf("add0 kept %d entries for a re-announced record, want 1: %+v", len(es), es)
+	}
+	if es[0].Expires != 2000 {
+		t.Fatalf("add0 did not refresh Expires on a duplicate rdata announcement: got %d, want 2000", es[0].Expires)
+	}
+	if es[0].refreshed != 0 {
+		t.Fatalf("add0 did not reset refreshed on a duplicate rdata announcement: got %d, want 0", es[0].refreshed)
+	}
+}
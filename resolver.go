@@ -0,0 +1,387 @@
+package zeroconf
+
+// Client-side browsing and resolution, modeled on the QueryParam
+// pattern used by other mDNS libraries.
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	dns "github.com/miekg/godns"
+)
+
+// QueryParam describes an mDNS question to ask and how to ask it.
+// WantUnicastResponse sets the QU bit (RFC 6762 §5.4) on the question.
+// Interface is not consulted by Lookup: the question goes out on every
+// interface the zone is bound to.
+type QueryParam struct {
+	Service             string
+	Domain              string
+	Type                uint16 // defaults to dns.TypePTR
+	Timeout             time.Duration
+	Context             context.Context
+	WantUnicastResponse bool
+	Interface           *net.Interface
+}
+
+// ServiceEntry is an assembled view of an mDNS-advertised service: the
+// PTR/SRV/TXT/A/AAAA records that together describe one instance,
+// correlated and merged as they arrive.
+type ServiceEntry struct {
+	Name       string
+	Host       string
+	AddrV4     net.IP
+	AddrV6     net.IP
+	Port       uint16
+	Info       string
+	InfoFields []string
+	TTL        uint32
+
+	txtSeen bool // whether a TXT record has been folded in yet
+}
+
+// complete reports whether se has everything Lookup/Browse/Watch need
+// before surfacing an entry: an address, a port, and a TXT record.
+// TXT is required even though it may carry no fields, since seeing it
+// is how we know no more of it is coming for this round.
+func (s *ServiceEntry) complete() bool {
+	return s.Host != "" && s.Port != 0 && s.txtSeen && (s.AddrV4 != nil || s.AddrV6 != nil)
+}
+
+// Resolver is a client for browsing and looking up mDNS services
+// advertised on a Zone.
+type Resolver struct {
+	zone Zone
+}
+
+// NewResolver returns a Resolver that queries and watches z.
+func NewResolver(z Zone) *Resolver {
+	return &Resolver{zone: z}
+}
+
+// Lookup sends an mDNS question built from params and streams the
+// ServiceEntry for each instance it learns of on the returned channel.
+// The channel is closed once the context (params.Context when set,
+// else ctx) is done or, when params.Timeout is positive, once it
+// elapses, whichever comes first.
+func (r *Resolver) Lookup(ctx context.Context, params *QueryParam) (<-chan *ServiceEntry, error) {
+	if params.Context != nil {
+		ctx = params.Context
+	}
+	qtype := params.Type
+	if qtype == 0 {
+		qtype = dns.TypePTR
+	}
+	service := serviceFqdn(params.Service, params.Domain)
+	qclass := uint16(dns.ClassINET)
+	if params.WantUnicastResponse {
+		qclass |= 1 << 15
+	}
+
+	sub := r.zone.Subscribe(dns.TypeANY)
+	results := make(chan *ServiceEntry, 16)
+
+	if err := r.zone.SendQuestion(dns.Question{service, qtype, qclass}); err != nil {
+		r.zone.Unsubscribe(sub)
+		return nil, err
+	}
+
+	var cancel context.CancelFunc
+	if params.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, params.Timeout)
+	}
+
+	go func() {
+		defer close(results)
+		defer r.zone.Unsubscribe(sub)
+		if cancel != nil {
+			defer cancel()
+		}
+		pending := make(map[string]*ServiceEntry)
+		emit := func(se *ServiceEntry) { results <- se }
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok := <-sub:
+				if !ok {
+					return
+				}
+				r.fold(pending, entry, service, nil, emit)
+			}
+		}
+	}()
+
+	return results, nil
+}
+
+// Browse is Lookup with a PTR question for service in domain.
+func (r *Resolver) Browse(ctx context.Context, service, domain string) (<-chan *ServiceEntry, error) {
+	return r.Lookup(ctx, &QueryParam{
+		Service: service,
+		Domain:  domain,
+		Type:    dns.TypePTR,
+	})
+}
+
+// EventKind classifies an Event surfaced by Watch.
+type EventKind int
+
+const (
+	Added EventKind = iota
+	Updated
+	Removed
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case Added:
+		return "Added"
+	case Updated:
+		return "Updated"
+	case Removed:
+		return "Removed"
+	}
+	return "Unknown"
+}
+
+// Event is an unsolicited change to a watched ServiceEntry.
+type Event struct {
+	Kind  EventKind
+	Entry *ServiceEntry
+}
+
+// Watch attaches to the zone's subscription stream and surfaces
+// Added/Updated/Removed events for service in domain as unsolicited
+// mDNS announcements arrive on 5353. Unlike Lookup/Browse, Watch never
+// sends a question of its own, so long-running callers can follow a
+// service's churn with zero query traffic.
+func (r *Resolver) Watch(ctx context.Context, service, domain string) (<-chan Event, error) {
+	scope := serviceFqdn(service, domain)
+	sub := r.zone.Subscribe(dns.TypeANY)
+	events := make(chan Event, 16)
+
+	go func() {
+		defer close(events)
+		defer r.zone.Unsubscribe(sub)
+		cache := make(map[string]*ServiceEntry)
+		pending := make(map[string]*ServiceEntry)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok := <-sub:
+				if !ok {
+					return
+				}
+				r.watchFold(cache, pending, entry, scope, events)
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+func (r *Resolver) watchFold(cache, pending map[string]*ServiceEntry, entry *Entry, scope string, events chan<- Event) {
+	if entry.RR.Header().Ttl == 0 {
+		r.watchGoodbye(cache, pending, entry.RR, scope, events)
+		return
+	}
+
+	seed := func(name string) *ServiceEntry {
+		se, ok := cache[name]
+		if !ok {
+			return nil
+		}
+		clone := *se
+		return &clone
+	}
+	emit := func(se *ServiceEntry) {
+		prev, existed := cache[se.Name]
+		cache[se.Name] = se
+		switch {
+		case !existed:
+			events <- Event{Kind: Added, Entry: se}
+		case !serviceEntryEqual(prev, se):
+			events <- Event{Kind: Updated, Entry: se}
+		}
+	}
+	// An address record names only a host: start every cached instance
+	// on that host from its snapshot so resolveHost can complete it.
+	switch entry.RR.(type) {
+	case *dns.RR_A, *dns.RR_AAAA:
+		host := entry.RR.Header().Name
+		for name, se := range cache {
+			if se.Host == host && pending[name] == nil {
+				pending[name] = seed(name)
+			}
+		}
+	}
+	r.fold(pending, entry, scope, seed, emit)
+}
+
+// watchGoodbye handles a TTL=0 announcement: it identifies the cached
+// ServiceEntry the goodbye RR refers to, evicts it, and emits Removed.
+// PTR/SRV/TXT goodbyes outside scope are ignored.
+func (r *Resolver) watchGoodbye(cache, pending map[string]*ServiceEntry, rr dns.RR, scope string, events chan<- Event) {
+	var name string
+	switch v := rr.(type) {
+	case *dns.RR_PTR:
+		if !underService(v.Ptr, scope) {
+			return
+		}
+		name = instanceName(v.Ptr)
+	case *dns.RR_SRV:
+		if !underService(v.Hdr.Name, scope) {
+			return
+		}
+		name = instanceName(v.Hdr.Name)
+	case *dns.RR_TXT:
+		if !underService(v.Hdr.Name, scope) {
+			return
+		}
+		name = instanceName(v.Hdr.Name)
+	case *dns.RR_A, *dns.RR_AAAA:
+		host := rr.Header().Name
+		for n, se := range cache {
+			if se.Host == host {
+				delete(cache, n)
+				delete(pending, n)
+				events <- Event{Kind: Removed, Entry: se}
+			}
+		}
+		return
+	default:
+		return
+	}
+	delete(pending, name)
+	if se, ok := cache[name]; ok {
+		delete(cache, name)
+		events <- Event{Kind: Removed, Entry: se}
+	}
+}
+
+func serviceEntryEqual(a, b *ServiceEntry) bool {
+	if a.Host != b.Host || a.Port != b.Port || a.TTL != b.TTL || a.Info != b.Info {
+		return false
+	}
+	if !a.AddrV4.Equal(b.AddrV4) || !a.AddrV6.Equal(b.AddrV6) {
+		return false
+	}
+	if len(a.InfoFields) != len(b.InfoFields) {
+		return false
+	}
+	for i := range a.InfoFields {
+		if a.InfoFields[i] != b.InfoFields[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fold merges a newly-arrived RR into the ServiceEntry it belongs to,
+// buffering partial entries in pending and calling emit only once an
+// entry becomes complete. scope, when non-empty, is the service FQDN
+// (as built by serviceFqdn) records must fall under to be admitted;
+// without it, an instance name that happens to be shared by two
+// different service types (the normal case for a host advertising
+// several services under one Bonjour-style name) would fold records
+// from both into the same pending entry. seed, if non-nil, supplies a
+// prior snapshot of a known instance to start from instead of a blank
+// ServiceEntry - Watch uses it so a lone refreshed TXT/A record can
+// still produce a complete entry to diff against the cache.
+func (r *Resolver) fold(pending map[string]*ServiceEntry, entry *Entry, scope string, seed func(string) *ServiceEntry, emit func(*ServiceEntry)) {
+	get := func(name string) *ServiceEntry {
+		se := pending[name]
+		if se == nil {
+			if seed != nil {
+				se = seed(name)
+			}
+			if se == nil {
+				se = &ServiceEntry{Name: name}
+			}
+			pending[name] = se
+		}
+		return se
+	}
+
+	switch rr := entry.RR.(type) {
+	case *dns.RR_PTR:
+		if !underService(rr.Ptr, scope) {
+			return
+		}
+		get(instanceName(rr.Ptr))
+	case *dns.RR_SRV:
+		if !underService(rr.Hdr.Name, scope) {
+			return
+		}
+		name := instanceName(rr.Hdr.Name)
+		se := get(name)
+		se.Host = rr.Target
+		se.Port = rr.Port
+		se.TTL = rr.Hdr.Ttl
+		r.emitIfComplete(pending, name, emit)
+	case *dns.RR_TXT:
+		if !underService(rr.Hdr.Name, scope) {
+			return
+		}
+		name := instanceName(rr.Hdr.Name)
+		se := get(name)
+		se.InfoFields = rr.Txt
+		se.Info = strings.Join(rr.Txt, "|")
+		se.txtSeen = true
+		r.emitIfComplete(pending, name, emit)
+	case *dns.RR_A:
+		r.resolveHost(pending, rr.Hdr.Name, rr.A, nil, emit)
+	case *dns.RR_AAAA:
+		r.resolveHost(pending, rr.Hdr.Name, nil, rr.AAAA, emit)
+	}
+}
+
+// underService reports whether fqdn (a PTR target, or an SRV/TXT
+// owner name) belongs to the service identified by scope, a FQDN
+// built by serviceFqdn. An empty scope matches everything.
+func underService(fqdn, scope string) bool {
+	return scope == "" || fqdn == scope || strings.HasSuffix(fqdn, "."+scope)
+}
+
+// resolveHost attaches an address to every pending entry whose SRV
+// target matches host.
+func (r *Resolver) resolveHost(pending map[string]*ServiceEntry, host string, v4, v6 net.IP, emit func(*ServiceEntry)) {
+	for name, se := range pending {
+		if se.Host != host {
+			continue
+		}
+		if v4 != nil {
+			se.AddrV4 = v4
+		}
+		if v6 != nil {
+			se.AddrV6 = v6
+		}
+		r.emitIfComplete(pending, name, emit)
+	}
+}
+
+func (r *Resolver) emitIfComplete(pending map[string]*ServiceEntry, name string, emit func(*ServiceEntry)) {
+	se := pending[name]
+	if se != nil && se.complete() {
+		emit(se)
+		delete(pending, name)
+	}
+}
+
+// instanceName strips the trailing "._service._proto.domain." suffix
+// off an SRV/TXT owner name (or a PTR target), leaving the bare
+// instance name used to key pending ServiceEntry assembly.
+func instanceName(fqdn string) string {
+	return strings.Split(fqdn, ".")[0]
+}
+
+func serviceFqdn(service, domain string) string {
+	if domain == "" {
+		domain = "local."
+	}
+	return service + "." + domain
+}
@@ -0,0 +1,99 @@
+package zeroconf
+
+import (
+	"net"
+	"testing"
+
+	dns "github.com/miekg/godns"
+)
+
+func TestServiceEntryCompleteRequiresTXT(t *testing.T) {
+	se := &ServiceEntry{Host: "foo.local.", Port: 1234, AddrV4: net.ParseIP("127.0.0.1")}
+	if se.complete() {
+		t.Fatal("complete() returned true before a TXT record was seen")
+	}
+
+	se.txtSeen = true
+	if !se.complete() {
+		t.Fatal("complete() returned false once address, port and TXT were all present")
+	}
+}
+
+func TestFoldPopulatesInfoFromTXT(t *testing.T) {
+	r := &Resolver{}
+	pending := make(map[string]*ServiceEntry)
+
+	txt := dns.NewRR(dns.TypeTXT).(*dns.RR_TXT)
+	txt.Hdr.Name = "inst._svc._tcp.local."
+	txt.Txt = []string{"a=1", "b=2"}
+
+	var emitted *ServiceEntry
+	emit := func(se *ServiceEntry) { emitted = se }
+
+	r.fold(pending, &Entry{RR: txt}, "", nil, emit)
+
+	se := pending["inst"]
+	if se == nil {
+		t.Fatal("fold did not create a pending entry for the TXT owner name")
+	}
+	if se.Info != "a=1|b=2" {
+		t.Fatalf("Info = %q, want %q", se.Info, "a=1|b=2")
+	}
+	if !se.txtSeen {
+		t.Fatal("fold did not mark txtSeen after a TXT record")
+	}
+	if emitted != nil {
+		t.Fatal("fold emitted an entry missing Host/Port/address")
+	}
+}
+
+func TestFoldIgnoresRecordsOutsideScope(t *testing.T) {
+	r := &Resolver{}
+	pending := make(map[string]*ServiceEntry)
+
+	// Same instance name, two different service types - a host
+	// advertising both _http and _ssh under "host1" is the normal
+	// Bonjour/Avahi case, not an edge case.
+	httpSRV := dns.NewRR(dns.TypeSRV).(*dns.RR_SRV)
+	httpSRV.Hdr.Name = "host1._http._tcp.local."
+	httpSRV.Target = "host1.local."
+	httpSRV.Port = 80
+
+	sshSRV := dns.NewRR(dns.TypeSRV).(*dns.RR_SRV)
+	sshSRV.Hdr.Name = "host1._ssh._tcp.local."
+	sshSRV.Target = "host1.local."
+	sshSRV.Port = 22
+
+	emit := func(*ServiceEntry) {}
+	r.fold(pending, &Entry{RR: httpSRV}, "_http._tcp.local.", nil, emit)
+	r.fold(pending, &Entry{RR: sshSRV}, "_http._tcp.local.", nil, emit)
+
+	se := pending["host1"]
+	if se == nil {
+		t.Fatal("fold did not admit the in-scope _http SRV record")
+	}
+	if se.Port != 80 {
+		t.Fatalf("Port = %d, want 80 - an out-of-scope _ssh SRV record must not overwrite it", se.Port)
+	}
+}
+
+func TestWatchFoldIgnoresOtherServices(t *testing.T) {
+	r := &Resolver{}
+	cache := make(map[string]*ServiceEntry)
+	pending := make(map[string]*ServiceEntry)
+	scope := serviceFqdn("_http._tcp", "local.")
+
+	httpPTR := newPTR(scope, "host1._http._tcp.local.")
+	sshPTR := newPTR(serviceFqdn("_ssh._tcp", "local."), "host1._ssh._tcp.local.")
+
+	events := make(chan Event, 16)
+	r.watchFold(cache, pending, &Entry{RR: httpPTR, Publish: true}, scope, events)
+	r.watchFold(cache, pending, &Entry{RR: sshPTR, Publish: true}, scope, events)
+
+	if _, ok := pending["host1"]; !ok {
+		t.Fatal("watchFold dropped the in-scope _http PTR record")
+	}
+	if len(pending) != 1 {
+		t.Fatalf("watchFold admitted an out-of-scope _ssh record into pending: %+v", pending)
+	}
+}